@@ -1,6 +1,8 @@
 package slackauth
 
 import (
+	"context"
+	"crypto/sha256"
 	"errors"
 	"html/template"
 	"io"
@@ -8,6 +10,7 @@ import (
 	"log"
 	"net/http"
 	"os"
+	"strings"
 	"time"
 
 	"github.com/nlopes/slack"
@@ -15,26 +18,69 @@ import (
 	log15 "gopkg.in/inconshreveable/log15.v2"
 )
 
+// Slack OAuth scopes for classic "Add to Slack" apps.
+const (
+	BOT      = "bot"
+	COMMANDS = "commands"
+)
+
 // Service is a service to authenticate on slack using the "Add to slack" button.
 type Service interface {
 	// SetLogOutput sets the place where logs will be written.
 	SetLogOutput(io.Writer)
 
-	// Run will run the service. This method blocks until the service crashes or stops.
-	Run() error
+	// Run will run the service. This method blocks until ctx is cancelled or the
+	// server crashes. Cancelling ctx triggers a graceful shutdown, bounded by
+	// Options.ShutdownTimeout.
+	Run(ctx context.Context) error
+
+	// RunBackground runs the service with a background context, matching the
+	// pre-context-aware Run signature. Deprecated: use Run(ctx) so the server can
+	// be shut down gracefully.
+	RunBackground() error
 
 	// OnAuth sets the handler that will be triggered every time someone authorizes slack
 	// successfully.
 	OnAuth(func(*slack.OAuthResponse))
+
+	// OnAuthV2 sets the handler that will be triggered every time someone authorizes
+	// slack successfully, when Options.UseOAuthV2 is set.
+	OnAuthV2(func(*OAuthV2Response))
+
+	// HandleCommand registers fn to answer the slash-command Slack posts to path,
+	// guarded by Options.SigningSecret request signature verification. Returns an
+	// error without registering fn if Options.SigningSecret is empty, since there
+	// would then be nothing stopping a forged request from reaching fn.
+	HandleCommand(path string, fn func(SlashCommand) Response) error
+
+	// HandleInteraction registers fn to answer the interactive component callback
+	// identified by callbackID, guarded by Options.SigningSecret request signature
+	// verification. Returns an error without registering fn if Options.SigningSecret
+	// is empty, since there would then be nothing stopping a forged request from
+	// reaching fn.
+	HandleInteraction(callbackID string, fn func(InteractionCallback) Response) error
+
+	// Token returns the token stored for teamID, as persisted automatically on
+	// every successful v1 OAuth callback.
+	Token(teamID string) (*slack.OAuthResponse, error)
+
+	// TokenV2 returns the token stored for teamID, as persisted automatically
+	// on every successful OAuth callback when Options.UseOAuthV2 is set.
+	TokenV2(teamID string) (*OAuthV2Response, error)
 }
 
 type slackAPI interface {
-	GetOAuthResponse(string, string, string, bool) (*slack.OAuthResponse, error)
+	GetOAuthResponse(id, secret, code, codeVerifier string, debug bool) (*slack.OAuthResponse, error)
+	GetOAuthV2Response(id, secret, code, codeVerifier string, debug bool) (*OAuthV2Response, error)
 }
 
 type slackAPIWrapper struct{}
 
-func (*slackAPIWrapper) GetOAuthResponse(id, secret, code string, debug bool) (*slack.OAuthResponse, error) {
+// GetOAuthResponse exchanges code on Slack's v1 oauth.access endpoint.
+// codeVerifier is always empty here: that endpoint predates PKCE and has no
+// code_verifier parameter to send it on, which is why New() refuses
+// EnablePKCE unless UseOAuthV2 is also set.
+func (*slackAPIWrapper) GetOAuthResponse(id, secret, code, codeVerifier string, debug bool) (*slack.OAuthResponse, error) {
 	if debug {
 		slack.SetLogger(log.New(os.Stdout, "", log.LstdFlags))
 	}
@@ -42,35 +88,134 @@ func (*slackAPIWrapper) GetOAuthResponse(id, secret, code string, debug bool) (*
 }
 
 type slackAuth struct {
-	clientID     string
-	clientSecret string
-	addr         string
-	certFile     string
-	keyFile      string
-	successTpl   *template.Template
-	errorTpl     *template.Template
-	debug        bool
-	auths        chan *slack.OAuthResponse
-	callback     func(*slack.OAuthResponse)
-	api          slackAPI
+	credentials   CredentialsProvider
+	addr          string
+	certFile      string
+	keyFile       string
+	successTpl    *template.Template
+	errorTpl      *template.Template
+	buttonTpl     *template.Template
+	authorizePath string
+	redirectURI   string
+	enablePKCE    bool
+	useOAuthV2    bool
+	states        *stateStore
+	debug         bool
+	auths         chan *slack.OAuthResponse
+	authsV2       chan *OAuthV2Response
+	callback      func(*slack.OAuthResponse)
+	callbackV2    func(*OAuthV2Response)
+	api           slackAPI
+
+	signingSecret    string
+	mutualTLSHeader  *string
+	interactionsPath string
+	commands         map[string]func(SlashCommand) Response
+	interactions     map[string]func(InteractionCallback) Response
+
+	tokenStore   TokenStore
+	tokenStoreV2 TokenStoreV2
+
+	readTimeout     time.Duration
+	writeTimeout    time.Duration
+	idleTimeout     time.Duration
+	shutdownTimeout time.Duration
 }
 
 // Options has all the configurable parameters for slack authenticator.
 type Options struct {
-	Addr         string
+	Addr       string
+	SuccessTpl string
+	ErrorTpl   string
+	ButtonTpl  string
+	Debug      bool
+	CertFile   string
+	KeyFile    string
+
+	// ClientID, ClientSecret, Scopes and UserScopes are used to build the
+	// default StaticCredentials when Credentials below is left unset.
+	// ClientSecret is also the source of the default EncryptionKey.
 	ClientID     string
 	ClientSecret string
-	SuccessTpl   string
-	ErrorTpl     string
-	Debug        bool
-	CertFile     string
-	KeyFile      string
+	Scopes       []string
+	UserScopes   []string
+
+	// Credentials resolves the client ID/secret and scopes to use for a given
+	// authorize or callback request, letting a single deployment host several
+	// Slack apps. Defaults to StaticCredentials built from ClientID,
+	// ClientSecret, Scopes and UserScopes above.
+	Credentials CredentialsProvider
+
+	// AuthorizePath is the path that redirects the browser to Slack's
+	// OAuth authorize endpoint. Defaults to "/authorize" when empty.
+	AuthorizePath string
+	// RedirectURI is sent to Slack as redirect_uri, so the callback can be
+	// routed back to a host/path different from Addr (e.g. behind a proxy).
+	RedirectURI string
+	// EnablePKCE adds a PKCE (RFC 7636) code challenge to the authorize
+	// redirect and its verifier to the callback's token exchange.
+	EnablePKCE bool
+	// UseOAuthV2 switches the callback's token exchange to Slack's
+	// oauth.v2.access endpoint, delivering an *OAuthV2Response (with
+	// separate bot/user tokens) to OnAuthV2 instead of OnAuth.
+	UseOAuthV2 bool
+
+	// SigningSecret enables slash-command and interaction handlers
+	// registered with HandleCommand/HandleInteraction, verifying that
+	// requests are signed by Slack.
+	SigningSecret string
+	// MutualTLSHeader, when set, names an additional header (populated by
+	// a reverse proxy terminating mutual TLS) that must carry a
+	// Slack-issued client certificate CN before a command or interaction
+	// request is accepted.
+	MutualTLSHeader *string
+	// InteractionsPath is the single path interactive-component payloads
+	// are posted to, dispatched to handlers by their callback ID.
+	// Defaults to "/interactions" when empty.
+	InteractionsPath string
+
+	// TokenStore persists the v1 token issued on every successful OAuth
+	// callback, keyed by team ID. Defaults to an in-memory store. Unused
+	// when UseOAuthV2 is set; see TokenStoreV2.
+	TokenStore TokenStore
+	// TokenStoreV2 persists the v2 token issued on every successful OAuth
+	// callback when UseOAuthV2 is set, keyed by team ID. Defaults to an
+	// in-memory store.
+	TokenStoreV2 TokenStoreV2
+	// EncryptionKey is the AES key (16, 24 or 32 bytes for AES-128/192/256)
+	// the default in-memory TokenStore and TokenStoreV2 use to encrypt
+	// tokens at rest. It is not passed to a TokenStore or TokenStoreV2 set
+	// above; the file and Redis stores encrypt with the key given to their
+	// constructors. When empty
+	// and Credentials is unset, a key is derived from ClientSecret so
+	// tokens are never stored in the clear; setting this explicitly is
+	// recommended regardless. Required when Credentials is set, since
+	// there is then no single ClientSecret to derive a key from.
+	EncryptionKey []byte
+
+	// ReadTimeout is the underlying http.Server's ReadTimeout. Defaults to 1 second.
+	ReadTimeout time.Duration
+	// WriteTimeout is the underlying http.Server's WriteTimeout. Defaults to 3 seconds.
+	WriteTimeout time.Duration
+	// IdleTimeout is the underlying http.Server's IdleTimeout.
+	IdleTimeout time.Duration
+	// ShutdownTimeout bounds how long Run(ctx) waits for in-flight requests to
+	// drain once ctx is cancelled. Defaults to 5 seconds.
+	ShutdownTimeout time.Duration
 }
 
 // New creates a new slackauth service.
 func New(opts Options) (Service, error) {
-	if opts.Addr == "" || opts.ClientID == "" || opts.ClientSecret == "" {
-		return nil, errors.New("slackauth: addr, client id and client secret can not be empty")
+	if opts.Addr == "" {
+		return nil, errors.New("slackauth: addr can not be empty")
+	}
+
+	if opts.Credentials == nil && (opts.ClientID == "" || opts.ClientSecret == "") {
+		return nil, errors.New("slackauth: client id and client secret can not be empty")
+	}
+
+	if opts.EnablePKCE && !opts.UseOAuthV2 {
+		return nil, errors.New("slackauth: EnablePKCE requires UseOAuthV2, since Slack's v1 oauth.access endpoint does not accept a code_verifier")
 	}
 
 	successTpl, err := readTemplate(opts.SuccessTpl)
@@ -83,22 +228,109 @@ func New(opts Options) (Service, error) {
 		return nil, err
 	}
 
+	buttonTpl, err := readTemplate(opts.ButtonTpl)
+	if err != nil {
+		return nil, err
+	}
+
+	if opts.Credentials == nil && len(opts.Scopes) == 0 {
+		return nil, errors.New("slackauth: scopes can not be empty")
+	}
+
+	credentials := opts.Credentials
+	if credentials == nil {
+		credentials = StaticCredentials{
+			ClientID:     opts.ClientID,
+			ClientSecret: opts.ClientSecret,
+			Scopes:       opts.Scopes,
+			UserScopes:   opts.UserScopes,
+		}
+	}
+
+	authorizePath := opts.AuthorizePath
+	if authorizePath == "" {
+		authorizePath = "/authorize"
+	}
+
+	interactionsPath := opts.InteractionsPath
+	if interactionsPath == "" {
+		interactionsPath = "/interactions"
+	}
+
+	encryptionKey := opts.EncryptionKey
+	if len(encryptionKey) == 0 {
+		if opts.Credentials != nil {
+			return nil, errors.New("slackauth: EncryptionKey can not be empty when Credentials is set, since there is no single ClientSecret to derive it from")
+		}
+		sum := sha256.Sum256([]byte(opts.ClientSecret))
+		encryptionKey = sum[:]
+	}
+
+	tokenStore := opts.TokenStore
+	if tokenStore == nil {
+		tokenStore = newMemoryTokenStore(encryptionKey)
+	}
+
+	tokenStoreV2 := opts.TokenStoreV2
+	if tokenStoreV2 == nil {
+		tokenStoreV2 = newMemoryTokenStoreV2(encryptionKey)
+	}
+
+	readTimeout := opts.ReadTimeout
+	if readTimeout == 0 {
+		readTimeout = 1 * time.Second
+	}
+
+	writeTimeout := opts.WriteTimeout
+	if writeTimeout == 0 {
+		writeTimeout = 3 * time.Second
+	}
+
+	shutdownTimeout := opts.ShutdownTimeout
+	if shutdownTimeout == 0 {
+		shutdownTimeout = 5 * time.Second
+	}
+
 	return &slackAuth{
-		clientID:     opts.ClientID,
-		clientSecret: opts.ClientSecret,
-		addr:         opts.Addr,
-		successTpl:   successTpl,
-		errorTpl:     errorTpl,
-		debug:        opts.Debug,
-		certFile:     opts.CertFile,
-		keyFile:      opts.KeyFile,
-		auths:        make(chan *slack.OAuthResponse, 1),
-		api:          &slackAPIWrapper{},
+		credentials:   credentials,
+		addr:          opts.Addr,
+		successTpl:    successTpl,
+		errorTpl:      errorTpl,
+		buttonTpl:     buttonTpl,
+		authorizePath: authorizePath,
+		redirectURI:   opts.RedirectURI,
+		enablePKCE:    opts.EnablePKCE,
+		useOAuthV2:    opts.UseOAuthV2,
+		states:        newStateStore(),
+		debug:         opts.Debug,
+		certFile:      opts.CertFile,
+		keyFile:       opts.KeyFile,
+		auths:         make(chan *slack.OAuthResponse, 1),
+		authsV2:       make(chan *OAuthV2Response, 1),
+		api:           &slackAPIWrapper{},
+
+		signingSecret:    opts.SigningSecret,
+		mutualTLSHeader:  opts.MutualTLSHeader,
+		interactionsPath: interactionsPath,
+		commands:         make(map[string]func(SlashCommand) Response),
+		interactions:     make(map[string]func(InteractionCallback) Response),
+
+		tokenStore:   tokenStore,
+		tokenStoreV2: tokenStoreV2,
+
+		readTimeout:     readTimeout,
+		writeTimeout:    writeTimeout,
+		idleTimeout:     opts.IdleTimeout,
+		shutdownTimeout: shutdownTimeout,
 	}, nil
 }
 
-func (s *slackAuth) Run() error {
+func (s *slackAuth) Run(ctx context.Context) error {
+	go s.states.runSweeper(ctx)
+
+	dispatchDone := make(chan struct{})
 	go func() {
+		defer close(dispatchDone)
 		for auth := range s.auths {
 			if s.callback != nil {
 				s.callback(auth)
@@ -108,7 +340,60 @@ func (s *slackAuth) Run() error {
 		}
 	}()
 
-	return s.runServer()
+	dispatchV2Done := make(chan struct{})
+	go func() {
+		defer close(dispatchV2Done)
+		for auth := range s.authsV2 {
+			if s.callbackV2 != nil {
+				s.callbackV2(auth)
+			} else {
+				log15.Warn("oauth v2 auth event triggered but there was no handler")
+			}
+		}
+	}()
+
+	srv := &http.Server{
+		Addr:         s.addr,
+		Handler:      s,
+		ReadTimeout:  s.readTimeout,
+		WriteTimeout: s.writeTimeout,
+		IdleTimeout:  s.idleTimeout,
+	}
+
+	serveErr := make(chan error, 1)
+	go func() {
+		var err error
+		if s.certFile != "" && s.keyFile != "" {
+			err = srv.ListenAndServeTLS(s.certFile, s.keyFile)
+		} else {
+			err = srv.ListenAndServe()
+		}
+		if err == http.ErrServerClosed {
+			err = nil
+		}
+		serveErr <- err
+	}()
+
+	var runErr error
+	select {
+	case runErr = <-serveErr:
+	case <-ctx.Done():
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), s.shutdownTimeout)
+		defer cancel()
+		runErr = srv.Shutdown(shutdownCtx)
+		<-serveErr
+	}
+
+	close(s.auths)
+	close(s.authsV2)
+	<-dispatchDone
+	<-dispatchV2Done
+
+	return runErr
+}
+
+func (s *slackAuth) RunBackground() error {
+	return s.Run(context.Background())
 }
 
 func (s *slackAuth) SetLogOutput(w io.Writer) {
@@ -132,23 +417,79 @@ func (s *slackAuth) OnAuth(fn func(*slack.OAuthResponse)) {
 	s.callback = fn
 }
 
-func (s *slackAuth) runServer() error {
-	srv := &http.Server{
-		ReadTimeout:  1 * time.Second,
-		WriteTimeout: 3 * time.Second,
-		Addr:         s.addr,
-		Handler:      s,
+func (s *slackAuth) OnAuthV2(fn func(*OAuthV2Response)) {
+	s.callbackV2 = fn
+}
+
+func (s *slackAuth) Token(teamID string) (*slack.OAuthResponse, error) {
+	return s.tokenStore.Get(teamID)
+}
+
+func (s *slackAuth) TokenV2(teamID string) (*OAuthV2Response, error) {
+	return s.tokenStoreV2.Get(teamID)
+}
+
+func (s *slackAuth) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if fn, ok := s.commands[r.URL.Path]; ok {
+		s.serveCommand(w, r, fn)
+		return
 	}
 
-	if s.certFile != "" && s.keyFile != "" {
-		return srv.ListenAndServeTLS(s.certFile, s.keyFile)
+	switch r.URL.Path {
+	case "/":
+		s.serveButton(w, r)
+	case s.authorizePath:
+		s.serveAuthorize(w, r)
+	case s.interactionsPath:
+		s.serveInteraction(w, r)
+	default:
+		s.serveCallback(w, r)
 	}
-	return srv.ListenAndServe()
 }
 
-func (s *slackAuth) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+// serveButton renders the "Add to Slack" button template with the resolved
+// client ID and comma-joined scopes; the link target is whatever the
+// template itself contains.
+func (s *slackAuth) serveButton(w http.ResponseWriter, r *http.Request) {
+	clientID, _, scopes, _, err := s.credentials.Resolve(r)
+	if err != nil {
+		http.Error(w, "slackauth: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	data := struct {
+		Scopes   string
+		ClientId string
+	}{
+		Scopes:   strings.Join(scopes, ","),
+		ClientId: clientID,
+	}
+
+	if err := s.buttonTpl.Execute(w, data); err != nil {
+		log15.Error("error displaying button tpl", "err", err.Error())
+	}
+}
+
+func (s *slackAuth) serveCallback(w http.ResponseWriter, r *http.Request) {
+	verifier, ok := s.verifyState(w, r)
+	if !ok {
+		return
+	}
+
+	clientID, clientSecret, _, _, err := s.credentials.Resolve(r)
+	if err != nil {
+		http.Error(w, "slackauth: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
 	code := r.FormValue("code")
-	resp, err := s.api.GetOAuthResponse(s.clientID, s.clientSecret, code, s.debug)
+
+	if s.useOAuthV2 {
+		s.serveCallbackV2(w, clientID, clientSecret, code, verifier)
+		return
+	}
+
+	resp, err := s.api.GetOAuthResponse(clientID, clientSecret, code, verifier, s.debug)
 	if err != nil {
 		log15.Error("error getting oauth response", "err", err.Error())
 		if err := s.errorTpl.Execute(w, resp); err != nil {
@@ -161,9 +502,34 @@ func (s *slackAuth) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		log15.Error("error displaying success tpl", "err", err.Error())
 	}
 
+	if err := s.tokenStore.Put(resp.TeamID, resp); err != nil {
+		log15.Error("error storing token", "team_id", resp.TeamID, "err", err.Error())
+	}
+
 	s.auths <- resp
 }
 
+func (s *slackAuth) serveCallbackV2(w http.ResponseWriter, clientID, clientSecret, code, verifier string) {
+	resp, err := s.api.GetOAuthV2Response(clientID, clientSecret, code, verifier, s.debug)
+	if err != nil {
+		log15.Error("error getting oauth v2 response", "err", err.Error())
+		if err := s.errorTpl.Execute(w, resp); err != nil {
+			log15.Error("error displaying error tpl", "err", err.Error())
+		}
+		return
+	}
+
+	if err := s.successTpl.Execute(w, resp); err != nil {
+		log15.Error("error displaying success tpl", "err", err.Error())
+	}
+
+	if err := s.tokenStoreV2.Put(resp.Team.ID, resp); err != nil {
+		log15.Error("error storing token", "team_id", resp.Team.ID, "err", err.Error())
+	}
+
+	s.authsV2 <- resp
+}
+
 func readTemplate(file string) (*template.Template, error) {
 	bytes, err := ioutil.ReadFile(file)
 	if err != nil {
@@ -171,4 +537,4 @@ func readTemplate(file string) (*template.Template, error) {
 	}
 
 	return template.New("").Parse(string(bytes))
-}
\ No newline at end of file
+}
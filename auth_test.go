@@ -1,6 +1,7 @@
 package slackauth
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"html/template"
@@ -17,7 +18,7 @@ import (
 
 type slackAPIMock struct{}
 
-func (*slackAPIMock) GetOAuthResponse(id, secret, code string, debug bool) (*slack.OAuthResponse, error) {
+func (*slackAPIMock) GetOAuthResponse(id, secret, code, codeVerifier string, debug bool) (*slack.OAuthResponse, error) {
 	if code == "invalid" {
 		return nil, errors.New("invalid code")
 	}
@@ -27,6 +28,16 @@ func (*slackAPIMock) GetOAuthResponse(id, secret, code string, debug bool) (*sla
 	}, nil
 }
 
+func (*slackAPIMock) GetOAuthV2Response(id, secret, code, codeVerifier string, debug bool) (*OAuthV2Response, error) {
+	if code == "invalid" {
+		return nil, errors.New("invalid code")
+	}
+
+	return &OAuthV2Response{
+		AccessToken: "foo",
+	}, nil
+}
+
 const (
 	tplSuccess = `<h1>Hello</h1>
 	<p>All went ok!</p>`
@@ -79,6 +90,16 @@ func TestNew(t *testing.T) {
 			ButtonTpl:    "valid.txt",
 			Scopes:       []string{},
 		}, true},
+		{Options{
+			Addr:         ":8080",
+			ClientID:     "foo",
+			ClientSecret: "bar",
+			SuccessTpl:   "valid.txt",
+			ErrorTpl:     "valid.txt",
+			ButtonTpl:    "valid.txt",
+			Scopes:       []string{BOT},
+			EnablePKCE:   true,
+		}, true},
 		{Options{
 			Addr:         ":8080",
 			ClientID:     "foo",
@@ -107,37 +128,82 @@ func TestSlackAuth(t *testing.T) {
 	successTpl := template.Must(template.New("success").Parse(tplSuccess))
 	errorTpl := template.Must(template.New("error").Parse(tplError))
 	auth := &slackAuth{
-		clientID:     "aaaa",
-		clientSecret: "bbbb",
-		addr:         ":8989",
-		successTpl:   successTpl,
-		errorTpl:     errorTpl,
-		debug:        true,
-		certFile:     "",
-		keyFile:      "",
-		auths:        make(chan *slack.OAuthResponse, 1),
-		api:          &slackAPIMock{},
+		credentials: StaticCredentials{
+			ClientID:     "aaaa",
+			ClientSecret: "bbbb",
+		},
+		addr:          ":8989",
+		successTpl:    successTpl,
+		errorTpl:      errorTpl,
+		authorizePath: "/authorize",
+		states:        newStateStore(),
+		debug:         true,
+		certFile:      "",
+		keyFile:       "",
+		auths:         make(chan *slack.OAuthResponse, 1),
+		authsV2:       make(chan *OAuthV2Response, 1),
+		api:           &slackAPIMock{},
+		tokenStore:    newMemoryTokenStore([]byte("0123456789abcdef")),
+		tokenStoreV2:  newMemoryTokenStoreV2([]byte("0123456789abcdef")),
 	}
 	auth.SetLogOutput(os.Stdout)
-	go auth.Run()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go auth.Run(ctx)
 
 	<-time.After(50 * time.Millisecond)
 
 	// This will not trigger an OnAuth event
-	testRequest(t, getUrlForAuth("fooo"), tplSuccess)
-	testRequest(t, getUrlForAuth("invalid"), tplError)
+	assert.Equal(t, tplSuccess, authCallback(t, "fooo"))
+	assert.Equal(t, tplError, authCallback(t, "invalid"))
 
 	var auths int
 	auth.OnAuth(func(auth *slack.OAuthResponse) {
 		auths++
 	})
-	testRequest(t, getUrlForAuth("fooo"), tplSuccess)
-	testRequest(t, getUrlForAuth("bar"), tplSuccess)
+	assert.Equal(t, tplSuccess, authCallback(t, "fooo"))
+	assert.Equal(t, tplSuccess, authCallback(t, "bar"))
 	assert.Equal(t, 2, auths)
 }
 
-func getUrlForAuth(code string) string {
-	return fmt.Sprintf("http://127.0.0.1:8989/auth?code=%s", code)
+// authCallback drives a full authorize-then-callback round trip against the
+// running test server: it starts an authorize leg to obtain a state and its
+// cookie, then replays both on the callback request with the given code, as
+// a real browser redirect would.
+func authCallback(t *testing.T, code string) string {
+	client := &http.Client{
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+
+	authResp, err := client.Get("http://127.0.0.1:8989/authorize")
+	assert.Nil(t, err)
+	defer authResp.Body.Close()
+
+	loc, err := authResp.Location()
+	assert.Nil(t, err)
+	state := loc.Query().Get("state")
+
+	var cookie *http.Cookie
+	for _, c := range authResp.Cookies() {
+		if c.Name == stateCookieName {
+			cookie = c
+		}
+	}
+	assert.NotNil(t, cookie)
+
+	req, err := http.NewRequest("GET", fmt.Sprintf("http://127.0.0.1:8989/auth?code=%s&state=%s", code, state), nil)
+	assert.Nil(t, err)
+	req.AddCookie(cookie)
+
+	resp, err := client.Do(req)
+	assert.Nil(t, err)
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	assert.Nil(t, err)
+	return string(body)
 }
 
 func testRequest(t *testing.T, url string, expected string) {
@@ -181,7 +247,9 @@ func TestSlackButton(t *testing.T) {
 	})
 	assert.Nil(t, err)
 
-	go auth.Run()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go auth.Run(ctx)
 	<-time.After(5 * time.Millisecond)
 
 	matcher, _ := regexp.Compile("<a[^>]+href=\"https://slack.com/oauth/authorize\\?scope=[^&\"]+&client_id=[^&\"]+\"[^>]*>[\\s\\S]*</a>")
@@ -189,3 +257,41 @@ func TestSlackButton(t *testing.T) {
 	found := matcher.Find(servedButtonCode)
 	assert.NotNil(t, found)
 }
+
+func TestGracefulShutdown(t *testing.T) {
+	assert.Nil(t, ioutil.WriteFile("valid.txt", []byte("foo"), 0777))
+	defer os.Remove("valid.txt")
+
+	auth, err := New(Options{
+		Addr:         ":8990",
+		ClientID:     "foo",
+		ClientSecret: "bar",
+		SuccessTpl:   "valid.txt",
+		ErrorTpl:     "valid.txt",
+		ButtonTpl:    "valid.txt",
+		Scopes:       []string{BOT},
+	})
+	assert.Nil(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	runDone := make(chan error, 1)
+	go func() {
+		runDone <- auth.Run(ctx)
+	}()
+
+	<-time.After(20 * time.Millisecond)
+	testRequest(t, "http://127.0.0.1:8990/", "foo")
+
+	cancel()
+
+	select {
+	case err := <-runDone:
+		assert.Nil(t, err)
+	case <-time.After(time.Second):
+		t.Fatal("Run did not return after the context was cancelled")
+	}
+
+	_, err = http.Get("http://127.0.0.1:8990/")
+	assert.NotNil(t, err, "server should no longer be accepting connections")
+}
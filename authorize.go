@@ -0,0 +1,200 @@
+package slackauth
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	stateCookieName = "slackauth_state"
+	stateTTL        = 10 * time.Minute
+
+	// stateSweepInterval is how often stateStore drops expired entries, so
+	// authorize requests that never complete with a matching callback
+	// don't grow the map without bound.
+	stateSweepInterval = time.Minute
+)
+
+// pkceEntry holds the PKCE code verifier issued for a single authorize
+// request, so it can be recovered once Slack redirects back to the
+// callback with the matching state.
+type pkceEntry struct {
+	verifier string
+	expires  time.Time
+}
+
+// stateStore tracks in-flight CSRF state values and their (optional) PKCE
+// code verifiers between the authorize redirect and the callback.
+type stateStore struct {
+	mu      sync.Mutex
+	entries map[string]pkceEntry
+}
+
+func newStateStore() *stateStore {
+	return &stateStore{entries: make(map[string]pkceEntry)}
+}
+
+func (s *stateStore) put(state, verifier string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.entries[state] = pkceEntry{verifier: verifier, expires: time.Now().Add(stateTTL)}
+}
+
+// take returns the verifier stored for state, if any, and removes the
+// entry so the same state can not be replayed.
+func (s *stateStore) take(state string) (string, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	entry, ok := s.entries[state]
+	delete(s.entries, state)
+	if !ok || time.Now().After(entry.expires) {
+		return "", false
+	}
+	return entry.verifier, true
+}
+
+// sweep removes every expired entry, bounding the memory an unauthenticated
+// client can consume by hitting /authorize repeatedly without ever
+// completing the callback leg.
+func (s *stateStore) sweep() {
+	now := time.Now()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for state, entry := range s.entries {
+		if now.After(entry.expires) {
+			delete(s.entries, state)
+		}
+	}
+}
+
+// runSweeper calls sweep on stateSweepInterval until ctx is done.
+func (s *stateStore) runSweeper(ctx context.Context) {
+	ticker := time.NewTicker(stateSweepInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			s.sweep()
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func randomToken(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// pkceChallenge derives the S256 code_challenge for a given code_verifier,
+// as described in RFC 7636.
+func pkceChallenge(verifier string) string {
+	sum := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// serveAuthorize redirects the browser to Slack's OAuth authorize endpoint.
+// It sets a random per-request state cookie that is checked again on the
+// callback to mitigate CSRF, and, when EnablePKCE is set, a PKCE code
+// challenge whose verifier is handed back on the token exchange.
+func (s *slackAuth) serveAuthorize(w http.ResponseWriter, r *http.Request) {
+	clientID, _, scopes, userScopes, err := s.credentials.Resolve(r)
+	if err != nil {
+		http.Error(w, "slackauth: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	state, err := randomToken(16)
+	if err != nil {
+		http.Error(w, "slackauth: could not generate state", http.StatusInternalServerError)
+		return
+	}
+
+	var verifier, challenge string
+	if s.enablePKCE {
+		verifier, err = randomToken(32)
+		if err != nil {
+			http.Error(w, "slackauth: could not generate code verifier", http.StatusInternalServerError)
+			return
+		}
+		challenge = pkceChallenge(verifier)
+	}
+	s.states.put(state, verifier)
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     stateCookieName,
+		Value:    state,
+		Path:     "/",
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		MaxAge:   int(stateTTL.Seconds()),
+	})
+
+	q := url.Values{}
+	q.Set("client_id", clientID)
+	q.Set("state", state)
+	if len(scopes) > 0 {
+		q.Set("scope", strings.Join(scopes, ","))
+	}
+	if len(userScopes) > 0 {
+		q.Set("user_scope", strings.Join(userScopes, ","))
+	}
+	if s.redirectURI != "" {
+		q.Set("redirect_uri", s.redirectURI)
+	}
+	if challenge != "" {
+		q.Set("code_challenge", challenge)
+		q.Set("code_challenge_method", "S256")
+	}
+
+	http.Redirect(w, r, "https://slack.com/oauth/v2/authorize?"+q.Encode(), http.StatusFound)
+}
+
+// verifyState checks the state query parameter Slack sends back to the
+// callback against the cookie set in serveAuthorize, rejecting the request
+// on mismatch. It returns the PKCE code verifier for this flow, if any.
+//
+// A callback carrying a code but no state did not come from our own
+// authorize redirect and is rejected outright: accepting it would let an
+// attacker complete their own OAuth authorize leg, then trick a victim's
+// browser into hitting this callback with the attacker's code, causing the
+// service to treat the attacker's authorization as the victim's (login
+// CSRF). A request with neither code nor state (e.g. a bare health check)
+// is not a callback at all and has nothing to verify.
+func (s *slackAuth) verifyState(w http.ResponseWriter, r *http.Request) (verifier string, ok bool) {
+	queryState := r.FormValue("state")
+	if queryState == "" {
+		if r.FormValue("code") == "" {
+			return "", true
+		}
+		http.Error(w, "slackauth: missing state", http.StatusForbidden)
+		return "", false
+	}
+
+	cookie, err := r.Cookie(stateCookieName)
+	if err != nil || subtle.ConstantTimeCompare([]byte(cookie.Value), []byte(queryState)) != 1 {
+		http.Error(w, "slackauth: invalid state", http.StatusForbidden)
+		return "", false
+	}
+
+	verifier, ok = s.states.take(queryState)
+	if !ok {
+		http.Error(w, "slackauth: invalid state", http.StatusForbidden)
+		return "", false
+	}
+	return verifier, true
+}
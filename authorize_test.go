@@ -0,0 +1,109 @@
+package slackauth
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestAuthorizeAuth() *slackAuth {
+	return &slackAuth{
+		credentials: StaticCredentials{
+			ClientID: "aaaa",
+			Scopes:   []string{BOT},
+		},
+		authorizePath: "/authorize",
+		states:        newStateStore(),
+	}
+}
+
+func TestVerifyStateMissingState(t *testing.T) {
+	auth := newTestAuthorizeAuth()
+
+	// No code and no state: not a callback, nothing to verify.
+	r := httptest.NewRequest("GET", "/auth", nil)
+	w := httptest.NewRecorder()
+	_, ok := auth.verifyState(w, r)
+	assert.True(t, ok)
+
+	// A code with no state looks like a login-CSRF attempt and must be
+	// rejected outright, not waved through as "nothing to verify".
+	r = httptest.NewRequest("GET", "/auth?code=attacker-code", nil)
+	w = httptest.NewRecorder()
+	_, ok = auth.verifyState(w, r)
+	assert.False(t, ok)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+}
+
+func TestVerifyStateMismatch(t *testing.T) {
+	auth := newTestAuthorizeAuth()
+	auth.states.put("expected-state", "verifier")
+
+	r := httptest.NewRequest("GET", "/auth?code=foo&state=wrong-state", nil)
+	r.AddCookie(&http.Cookie{Name: stateCookieName, Value: "expected-state"})
+	w := httptest.NewRecorder()
+
+	_, ok := auth.verifyState(w, r)
+	assert.False(t, ok)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+}
+
+func TestVerifyStateMissingCookie(t *testing.T) {
+	auth := newTestAuthorizeAuth()
+	auth.states.put("state-value", "verifier")
+
+	r := httptest.NewRequest("GET", "/auth?code=foo&state=state-value", nil)
+	w := httptest.NewRecorder()
+
+	_, ok := auth.verifyState(w, r)
+	assert.False(t, ok)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+}
+
+func TestVerifyStateSuccessAndReplay(t *testing.T) {
+	auth := newTestAuthorizeAuth()
+	auth.states.put("state-value", "the-verifier")
+
+	r := httptest.NewRequest("GET", "/auth?code=foo&state=state-value", nil)
+	r.AddCookie(&http.Cookie{Name: stateCookieName, Value: "state-value"})
+	w := httptest.NewRecorder()
+
+	verifier, ok := auth.verifyState(w, r)
+	assert.True(t, ok)
+	assert.Equal(t, "the-verifier", verifier)
+
+	// The state was consumed by the request above, so replaying it must fail.
+	r2 := httptest.NewRequest("GET", "/auth?code=foo&state=state-value", nil)
+	r2.AddCookie(&http.Cookie{Name: stateCookieName, Value: "state-value"})
+	w2 := httptest.NewRecorder()
+
+	_, ok = auth.verifyState(w2, r2)
+	assert.False(t, ok)
+}
+
+func TestServeAuthorizePKCE(t *testing.T) {
+	auth := newTestAuthorizeAuth()
+	auth.enablePKCE = true
+
+	r := httptest.NewRequest("GET", "/authorize", nil)
+	w := httptest.NewRecorder()
+	auth.serveAuthorize(w, r)
+
+	assert.Equal(t, http.StatusFound, w.Code)
+
+	loc, err := w.Result().Location()
+	assert.Nil(t, err)
+	assert.NotEmpty(t, loc.Query().Get("state"))
+	assert.Equal(t, "S256", loc.Query().Get("code_challenge_method"))
+	assert.NotEmpty(t, loc.Query().Get("code_challenge"))
+
+	var cookie *http.Cookie
+	for _, c := range w.Result().Cookies() {
+		if c.Name == stateCookieName {
+			cookie = c
+		}
+	}
+	assert.NotNil(t, cookie)
+}
@@ -0,0 +1,226 @@
+package slackauth
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"time"
+
+	log15 "gopkg.in/inconshreveable/log15.v2"
+)
+
+// signatureMaxAge is how far X-Slack-Request-Timestamp may drift from wall
+// clock before a request is rejected as a possible replay.
+const signatureMaxAge = 5 * time.Minute
+
+// Response is returned by slash-command and interaction handlers and is
+// serialized as the JSON body Slack receives back.
+type Response struct {
+	Text            string `json:"text,omitempty"`
+	ResponseType    string `json:"response_type,omitempty"`
+	ReplaceOriginal bool   `json:"replace_original,omitempty"`
+	DeleteOriginal  bool   `json:"delete_original,omitempty"`
+}
+
+// SlashCommand is the payload Slack posts to a registered slash-command
+// endpoint.
+type SlashCommand struct {
+	Token          string
+	TeamID         string
+	TeamDomain     string
+	EnterpriseID   string
+	EnterpriseName string
+	ChannelID      string
+	ChannelName    string
+	UserID         string
+	UserName       string
+	Command        string
+	Text           string
+	ResponseURL    string
+	TriggerID      string
+}
+
+func slashCommandFromForm(form url.Values) SlashCommand {
+	return SlashCommand{
+		Token:          form.Get("token"),
+		TeamID:         form.Get("team_id"),
+		TeamDomain:     form.Get("team_domain"),
+		EnterpriseID:   form.Get("enterprise_id"),
+		EnterpriseName: form.Get("enterprise_name"),
+		ChannelID:      form.Get("channel_id"),
+		ChannelName:    form.Get("channel_name"),
+		UserID:         form.Get("user_id"),
+		UserName:       form.Get("user_name"),
+		Command:        form.Get("command"),
+		Text:           form.Get("text"),
+		ResponseURL:    form.Get("response_url"),
+		TriggerID:      form.Get("trigger_id"),
+	}
+}
+
+// InteractionCallback is the payload Slack posts for interactive
+// components (buttons, menus, modals...), decoded from the request's
+// "payload" form field.
+type InteractionCallback struct {
+	Type        string             `json:"type"`
+	Token       string             `json:"token"`
+	CallbackID  string             `json:"callback_id"`
+	TriggerID   string             `json:"trigger_id"`
+	ResponseURL string             `json:"response_url"`
+	ActionTs    string             `json:"action_ts"`
+	Team        InteractionTeam    `json:"team"`
+	Channel     InteractionChannel `json:"channel"`
+	User        InteractionUser    `json:"user"`
+}
+
+// InteractionTeam identifies the workspace an interaction happened in.
+type InteractionTeam struct {
+	ID     string `json:"id"`
+	Domain string `json:"domain"`
+}
+
+// InteractionChannel identifies the channel an interaction happened in.
+type InteractionChannel struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+}
+
+// InteractionUser identifies the user who triggered an interaction.
+type InteractionUser struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+}
+
+// HandleCommand registers fn to answer the slash-command Slack posts to
+// path, guarded by request signature verification.
+func (s *slackAuth) HandleCommand(path string, fn func(SlashCommand) Response) error {
+	if s.signingSecret == "" {
+		return errors.New("slackauth: Options.SigningSecret must be set before registering a command handler")
+	}
+	s.commands[path] = fn
+	return nil
+}
+
+// HandleInteraction registers fn to answer the interactive component
+// callback identified by callbackID, guarded by request signature
+// verification.
+func (s *slackAuth) HandleInteraction(callbackID string, fn func(InteractionCallback) Response) error {
+	if s.signingSecret == "" {
+		return errors.New("slackauth: Options.SigningSecret must be set before registering an interaction handler")
+	}
+	s.interactions[callbackID] = fn
+	return nil
+}
+
+func (s *slackAuth) serveCommand(w http.ResponseWriter, r *http.Request, fn func(SlashCommand) Response) {
+	body, ok := s.verifySignature(w, r)
+	if !ok {
+		return
+	}
+
+	form, err := url.ParseQuery(string(body))
+	if err != nil {
+		http.Error(w, "slackauth: invalid body", http.StatusBadRequest)
+		return
+	}
+
+	writeResponse(w, fn(slashCommandFromForm(form)))
+}
+
+func (s *slackAuth) serveInteraction(w http.ResponseWriter, r *http.Request) {
+	body, ok := s.verifySignature(w, r)
+	if !ok {
+		return
+	}
+
+	form, err := url.ParseQuery(string(body))
+	if err != nil {
+		http.Error(w, "slackauth: invalid body", http.StatusBadRequest)
+		return
+	}
+
+	var cb InteractionCallback
+	if err := json.Unmarshal([]byte(form.Get("payload")), &cb); err != nil {
+		http.Error(w, "slackauth: invalid payload", http.StatusBadRequest)
+		return
+	}
+
+	fn, ok := s.interactions[cb.CallbackID]
+	if !ok {
+		log15.Warn("interaction event triggered but there was no handler", "callback_id", cb.CallbackID)
+		http.Error(w, "slackauth: unknown callback id", http.StatusNotFound)
+		return
+	}
+
+	writeResponse(w, fn(cb))
+}
+
+func writeResponse(w http.ResponseWriter, resp Response) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		log15.Error("error encoding response", "err", err.Error())
+	}
+}
+
+// verifySignature authenticates a slash-command or interaction request per
+// Slack's request signing scheme. It returns the raw request body on
+// success, having rejected replayed or forged requests with a 401 (or 403
+// when MutualTLSHeader is configured and does not match).
+func (s *slackAuth) verifySignature(w http.ResponseWriter, r *http.Request) ([]byte, bool) {
+	if s.mutualTLSHeader != nil && !mutualTLSMatches(r.Header.Get(*s.mutualTLSHeader)) {
+		http.Error(w, "slackauth: mutual TLS verification failed", http.StatusForbidden)
+		return nil, false
+	}
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, "slackauth: could not read body", http.StatusBadRequest)
+		return nil, false
+	}
+	r.Body.Close()
+
+	ts := r.Header.Get("X-Slack-Request-Timestamp")
+	sig := r.Header.Get("X-Slack-Signature")
+
+	if !s.validSignature(ts, sig, body) {
+		http.Error(w, "slackauth: invalid request signature", http.StatusUnauthorized)
+		return nil, false
+	}
+
+	return body, true
+}
+
+func (s *slackAuth) validSignature(ts, sig string, body []byte) bool {
+	seconds, err := strconv.ParseInt(ts, 10, 64)
+	if err != nil {
+		return false
+	}
+
+	if age := time.Since(time.Unix(seconds, 0)); age < -signatureMaxAge || age > signatureMaxAge {
+		return false
+	}
+
+	mac := hmac.New(sha256.New, []byte(s.signingSecret))
+	mac.Write([]byte("v0:" + ts + ":" + string(body)))
+	expected := "v0=" + hex.EncodeToString(mac.Sum(nil))
+
+	return subtle.ConstantTimeCompare([]byte(expected), []byte(sig)) == 1
+}
+
+// mutualTLSPattern matches the CN Slack issues its mutual TLS client
+// certificates with. The CN field must end in ".slack.com" (anchored to
+// the next comma or end of header) so a certificate for an attacker-owned
+// domain like "foo.slack.com.attacker.example" does not match.
+var mutualTLSPattern = regexp.MustCompile(`CN=[^,]*\.slack\.com(,|$)`)
+
+func mutualTLSMatches(header string) bool {
+	return header != "" && mutualTLSPattern.MatchString(header)
+}
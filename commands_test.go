@@ -0,0 +1,67 @@
+package slackauth
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestValidSignature(t *testing.T) {
+	auth := &slackAuth{signingSecret: "shhh"}
+	body := "token=foo&team_id=bar"
+
+	ts := strconv.FormatInt(time.Now().Unix(), 10)
+	sig := signBody(t, "shhh", ts, body)
+	assert.True(t, auth.validSignature(ts, sig, []byte(body)))
+
+	assert.False(t, auth.validSignature(ts, "v0=deadbeef", []byte(body)), "wrong signature")
+	assert.False(t, auth.validSignature(ts, signBody(t, "wrong-secret", ts, body), []byte(body)), "wrong secret")
+
+	staleTs := strconv.FormatInt(time.Now().Add(-10*time.Minute).Unix(), 10)
+	assert.False(t, auth.validSignature(staleTs, signBody(t, "shhh", staleTs, body), []byte(body)), "stale timestamp")
+}
+
+func signBody(t *testing.T, secret, ts, body string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	_, err := mac.Write([]byte("v0:" + ts + ":" + body))
+	assert.Nil(t, err)
+	return "v0=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+func TestHandleCommandRequiresSigningSecret(t *testing.T) {
+	auth := &slackAuth{commands: make(map[string]func(SlashCommand) Response)}
+
+	err := auth.HandleCommand("/cmd", func(SlashCommand) Response { return Response{} })
+	assert.NotNil(t, err)
+	assert.Empty(t, auth.commands)
+
+	auth.signingSecret = "shhh"
+	assert.Nil(t, auth.HandleCommand("/cmd", func(SlashCommand) Response { return Response{} }))
+	assert.Len(t, auth.commands, 1)
+}
+
+func TestHandleInteractionRequiresSigningSecret(t *testing.T) {
+	auth := &slackAuth{interactions: make(map[string]func(InteractionCallback) Response)}
+
+	err := auth.HandleInteraction("callback-id", func(InteractionCallback) Response { return Response{} })
+	assert.NotNil(t, err)
+	assert.Empty(t, auth.interactions)
+
+	auth.signingSecret = "shhh"
+	assert.Nil(t, auth.HandleInteraction("callback-id", func(InteractionCallback) Response { return Response{} }))
+	assert.Len(t, auth.interactions, 1)
+}
+
+func TestMutualTLSMatches(t *testing.T) {
+	assert.True(t, mutualTLSMatches("CN=foo.slack.com"))
+	assert.True(t, mutualTLSMatches("Subject=CN=foo.slack.com,OU=Slack"))
+
+	assert.False(t, mutualTLSMatches(""))
+	assert.False(t, mutualTLSMatches("CN=foo.slack.com.attacker.example"))
+	assert.False(t, mutualTLSMatches("CN=attacker.example"))
+}
@@ -0,0 +1,26 @@
+package slackauth
+
+import "net/http"
+
+// CredentialsProvider resolves which Slack app credentials and scopes apply
+// to a given authorize or callback request, so a single deployment can host
+// several Slack apps — distinguished by hostname, path prefix, a query
+// parameter, or anything else the request carries.
+type CredentialsProvider interface {
+	Resolve(r *http.Request) (clientID, clientSecret string, scopes, userScopes []string, err error)
+}
+
+// StaticCredentials is a CredentialsProvider that always resolves to the
+// same client ID/secret and scopes, matching slackauth's original
+// single-tenant behavior.
+type StaticCredentials struct {
+	ClientID     string
+	ClientSecret string
+	Scopes       []string
+	UserScopes   []string
+}
+
+// Resolve implements CredentialsProvider.
+func (c StaticCredentials) Resolve(r *http.Request) (string, string, []string, []string, error) {
+	return c.ClientID, c.ClientSecret, c.Scopes, c.UserScopes, nil
+}
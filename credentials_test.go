@@ -0,0 +1,25 @@
+package slackauth
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStaticCredentialsResolve(t *testing.T) {
+	creds := StaticCredentials{
+		ClientID:     "aaaa",
+		ClientSecret: "bbbb",
+		Scopes:       []string{BOT, COMMANDS},
+		UserScopes:   []string{"chat:write"},
+	}
+
+	r := httptest.NewRequest("GET", "/authorize", nil)
+	clientID, clientSecret, scopes, userScopes, err := creds.Resolve(r)
+	assert.Nil(t, err)
+	assert.Equal(t, "aaaa", clientID)
+	assert.Equal(t, "bbbb", clientSecret)
+	assert.Equal(t, []string{BOT, COMMANDS}, scopes)
+	assert.Equal(t, []string{"chat:write"}, userScopes)
+}
@@ -0,0 +1,69 @@
+package slackauth
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+)
+
+// OAuthV2Response is the response returned by Slack's oauth.v2.access
+// endpoint. Unlike the v1 OAuthResponse, it separates the bot token from
+// the installing user's own token and carries team/enterprise metadata.
+type OAuthV2Response struct {
+	AccessToken         string            `json:"access_token"`
+	TokenType           string            `json:"token_type"`
+	Scope               string            `json:"scope"`
+	BotUserID           string            `json:"bot_user_id"`
+	AppID               string            `json:"app_id"`
+	AuthedUser          OAuthV2AuthedUser `json:"authed_user"`
+	Team                OAuthV2Team       `json:"team"`
+	Enterprise          *OAuthV2Team      `json:"enterprise"`
+	IsEnterpriseInstall bool              `json:"is_enterprise_install"`
+}
+
+// OAuthV2AuthedUser is the nested "authed_user" object in OAuthV2Response,
+// holding the token issued for the installing user rather than the bot.
+type OAuthV2AuthedUser struct {
+	ID          string `json:"id"`
+	Scope       string `json:"scope"`
+	AccessToken string `json:"access_token"`
+	TokenType   string `json:"token_type"`
+}
+
+// OAuthV2Team identifies the workspace (or "enterprise" grid) a v2 install
+// belongs to.
+type OAuthV2Team struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+}
+
+func (*slackAPIWrapper) GetOAuthV2Response(id, secret, code, codeVerifier string, debug bool) (*OAuthV2Response, error) {
+	form := url.Values{}
+	form.Set("client_id", id)
+	form.Set("client_secret", secret)
+	form.Set("code", code)
+	if codeVerifier != "" {
+		form.Set("code_verifier", codeVerifier)
+	}
+
+	httpResp, err := http.PostForm("https://slack.com/api/oauth.v2.access", form)
+	if err != nil {
+		return nil, err
+	}
+	defer httpResp.Body.Close()
+
+	var body struct {
+		OK    bool   `json:"ok"`
+		Error string `json:"error"`
+		OAuthV2Response
+	}
+	if err := json.NewDecoder(httpResp.Body).Decode(&body); err != nil {
+		return nil, err
+	}
+	if !body.OK {
+		return nil, fmt.Errorf("slackauth: %s", body.Error)
+	}
+
+	return &body.OAuthV2Response, nil
+}
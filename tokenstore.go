@@ -0,0 +1,501 @@
+package slackauth
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/nlopes/slack"
+)
+
+// ErrTokenNotFound is returned by a TokenStore's Get when teamID has no
+// stored token.
+var ErrTokenNotFound = errors.New("slackauth: token not found")
+
+// TokenStore persists the OAuth token issued for each Slack team or
+// workspace a user installs the app into. Implementations must encrypt
+// token bytes at rest.
+type TokenStore interface {
+	// Put stores tok for teamID, overwriting any previous value.
+	Put(teamID string, tok *slack.OAuthResponse) error
+	// Get returns the token stored for teamID, or ErrTokenNotFound.
+	Get(teamID string) (*slack.OAuthResponse, error)
+	// Delete removes the token stored for teamID.
+	Delete(teamID string) error
+	// List returns the team IDs with a stored token.
+	List() ([]string, error)
+}
+
+// encryptValue serializes v and seals it with AES-GCM under key, prefixing
+// the ciphertext with its nonce. Used to encrypt both v1 and v2 tokens.
+func encryptValue(key []byte, v interface{}) ([]byte, error) {
+	plaintext, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+
+	return gcm.Seal(nonce, nonce, plaintext, nil), nil
+}
+
+// decryptValue reverses encryptValue, unmarshaling the sealed plaintext
+// into v.
+func decryptValue(key, ciphertext []byte, v interface{}) error {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return err
+	}
+
+	if len(ciphertext) < gcm.NonceSize() {
+		return errors.New("slackauth: ciphertext too short")
+	}
+
+	nonce, data := ciphertext[:gcm.NonceSize()], ciphertext[gcm.NonceSize():]
+	plaintext, err := gcm.Open(nil, nonce, data, nil)
+	if err != nil {
+		return err
+	}
+
+	return json.Unmarshal(plaintext, v)
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// memoryTokenStore is the default TokenStore: tokens live only as long as
+// the process, encrypted the same as every other backend.
+type memoryTokenStore struct {
+	mu     sync.RWMutex
+	key    []byte
+	tokens map[string][]byte
+}
+
+func newMemoryTokenStore(key []byte) *memoryTokenStore {
+	return &memoryTokenStore{key: key, tokens: make(map[string][]byte)}
+}
+
+func (m *memoryTokenStore) Put(teamID string, tok *slack.OAuthResponse) error {
+	enc, err := encryptValue(m.key, tok)
+	if err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.tokens[teamID] = enc
+	return nil
+}
+
+func (m *memoryTokenStore) Get(teamID string) (*slack.OAuthResponse, error) {
+	m.mu.RLock()
+	enc, ok := m.tokens[teamID]
+	m.mu.RUnlock()
+	if !ok {
+		return nil, ErrTokenNotFound
+	}
+
+	var tok slack.OAuthResponse
+	if err := decryptValue(m.key, enc, &tok); err != nil {
+		return nil, err
+	}
+	return &tok, nil
+}
+
+func (m *memoryTokenStore) Delete(teamID string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.tokens, teamID)
+	return nil
+}
+
+func (m *memoryTokenStore) List() ([]string, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	teams := make([]string, 0, len(m.tokens))
+	for id := range m.tokens {
+		teams = append(teams, id)
+	}
+	return teams, nil
+}
+
+// fileTokenStore persists each team's token as its own encrypted file
+// inside dir.
+type fileTokenStore struct {
+	mu  sync.Mutex
+	key []byte
+	dir string
+}
+
+// NewFileTokenStore creates a TokenStore that keeps one encrypted file per
+// team under dir.
+func NewFileTokenStore(dir string, encryptionKey []byte) (TokenStore, error) {
+	if len(encryptionKey) == 0 {
+		return nil, errors.New("slackauth: encryption key can not be empty")
+	}
+	return &fileTokenStore{key: encryptionKey, dir: dir}, nil
+}
+
+func (f *fileTokenStore) path(teamID string) string {
+	return filepath.Join(f.dir, teamID+".json")
+}
+
+func (f *fileTokenStore) Put(teamID string, tok *slack.OAuthResponse) error {
+	enc, err := encryptValue(f.key, tok)
+	if err != nil {
+		return err
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := os.MkdirAll(f.dir, 0700); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(f.path(teamID), enc, 0600)
+}
+
+func (f *fileTokenStore) Get(teamID string) (*slack.OAuthResponse, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	enc, err := ioutil.ReadFile(f.path(teamID))
+	if os.IsNotExist(err) {
+		return nil, ErrTokenNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var tok slack.OAuthResponse
+	if err := decryptValue(f.key, enc, &tok); err != nil {
+		return nil, err
+	}
+	return &tok, nil
+}
+
+func (f *fileTokenStore) Delete(teamID string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := os.Remove(f.path(teamID)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+func (f *fileTokenStore) List() ([]string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	entries, err := ioutil.ReadDir(f.dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	teams := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		if !entry.IsDir() && filepath.Ext(entry.Name()) == ".json" {
+			teams = append(teams, strings.TrimSuffix(entry.Name(), ".json"))
+		}
+	}
+	return teams, nil
+}
+
+// RedisClient is the subset of a Redis client's API the Redis-backed
+// TokenStore needs, so callers can bring their own client (go-redis,
+// redigo...) without this package forcing one as a dependency.
+type RedisClient interface {
+	Set(key string, value []byte) error
+	Get(key string) ([]byte, error)
+	Del(key string) error
+	Keys(pattern string) ([]string, error)
+}
+
+// redisTokenStore keeps each team's token, keyed by teamID, in Redis.
+type redisTokenStore struct {
+	key    []byte
+	client RedisClient
+	prefix string
+}
+
+// NewRedisTokenStore creates a TokenStore that keeps tokens in Redis via
+// client, keyed per team.
+func NewRedisTokenStore(client RedisClient, encryptionKey []byte) (TokenStore, error) {
+	if len(encryptionKey) == 0 {
+		return nil, errors.New("slackauth: encryption key can not be empty")
+	}
+	return &redisTokenStore{key: encryptionKey, client: client, prefix: "slackauth:token:"}, nil
+}
+
+func (r *redisTokenStore) Put(teamID string, tok *slack.OAuthResponse) error {
+	enc, err := encryptValue(r.key, tok)
+	if err != nil {
+		return err
+	}
+	return r.client.Set(r.prefix+teamID, enc)
+}
+
+func (r *redisTokenStore) Get(teamID string) (*slack.OAuthResponse, error) {
+	enc, err := r.client.Get(r.prefix + teamID)
+	if err != nil {
+		return nil, err
+	}
+	if enc == nil {
+		return nil, ErrTokenNotFound
+	}
+
+	var tok slack.OAuthResponse
+	if err := decryptValue(r.key, enc, &tok); err != nil {
+		return nil, err
+	}
+	return &tok, nil
+}
+
+func (r *redisTokenStore) Delete(teamID string) error {
+	return r.client.Del(r.prefix + teamID)
+}
+
+func (r *redisTokenStore) List() ([]string, error) {
+	keys, err := r.client.Keys(r.prefix + "*")
+	if err != nil {
+		return nil, err
+	}
+
+	teams := make([]string, len(keys))
+	for i, key := range keys {
+		teams[i] = strings.TrimPrefix(key, r.prefix)
+	}
+	return teams, nil
+}
+
+// TokenStoreV2 persists the OAuth v2 token issued for each Slack team when
+// Options.UseOAuthV2 is set. It is kept separate from TokenStore, rather
+// than folded into it, so the bot/user token split, BotUserID and
+// enterprise metadata an OAuthV2Response carries are never silently
+// truncated to TokenStore's v1 *slack.OAuthResponse shape.
+type TokenStoreV2 interface {
+	// Put stores tok for teamID, overwriting any previous value.
+	Put(teamID string, tok *OAuthV2Response) error
+	// Get returns the token stored for teamID, or ErrTokenNotFound.
+	Get(teamID string) (*OAuthV2Response, error)
+	// Delete removes the token stored for teamID.
+	Delete(teamID string) error
+	// List returns the team IDs with a stored token.
+	List() ([]string, error)
+}
+
+// memoryTokenStoreV2 is the default TokenStoreV2: tokens live only as long
+// as the process, encrypted the same as every other backend.
+type memoryTokenStoreV2 struct {
+	mu     sync.RWMutex
+	key    []byte
+	tokens map[string][]byte
+}
+
+func newMemoryTokenStoreV2(key []byte) *memoryTokenStoreV2 {
+	return &memoryTokenStoreV2{key: key, tokens: make(map[string][]byte)}
+}
+
+func (m *memoryTokenStoreV2) Put(teamID string, tok *OAuthV2Response) error {
+	enc, err := encryptValue(m.key, tok)
+	if err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.tokens[teamID] = enc
+	return nil
+}
+
+func (m *memoryTokenStoreV2) Get(teamID string) (*OAuthV2Response, error) {
+	m.mu.RLock()
+	enc, ok := m.tokens[teamID]
+	m.mu.RUnlock()
+	if !ok {
+		return nil, ErrTokenNotFound
+	}
+
+	var tok OAuthV2Response
+	if err := decryptValue(m.key, enc, &tok); err != nil {
+		return nil, err
+	}
+	return &tok, nil
+}
+
+func (m *memoryTokenStoreV2) Delete(teamID string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.tokens, teamID)
+	return nil
+}
+
+func (m *memoryTokenStoreV2) List() ([]string, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	teams := make([]string, 0, len(m.tokens))
+	for id := range m.tokens {
+		teams = append(teams, id)
+	}
+	return teams, nil
+}
+
+// fileTokenStoreV2 persists each team's v2 token as its own encrypted file
+// inside dir.
+type fileTokenStoreV2 struct {
+	mu  sync.Mutex
+	key []byte
+	dir string
+}
+
+// NewFileTokenStoreV2 creates a TokenStoreV2 that keeps one encrypted file
+// per team under dir.
+func NewFileTokenStoreV2(dir string, encryptionKey []byte) (TokenStoreV2, error) {
+	if len(encryptionKey) == 0 {
+		return nil, errors.New("slackauth: encryption key can not be empty")
+	}
+	return &fileTokenStoreV2{key: encryptionKey, dir: dir}, nil
+}
+
+func (f *fileTokenStoreV2) path(teamID string) string {
+	return filepath.Join(f.dir, teamID+".json")
+}
+
+func (f *fileTokenStoreV2) Put(teamID string, tok *OAuthV2Response) error {
+	enc, err := encryptValue(f.key, tok)
+	if err != nil {
+		return err
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := os.MkdirAll(f.dir, 0700); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(f.path(teamID), enc, 0600)
+}
+
+func (f *fileTokenStoreV2) Get(teamID string) (*OAuthV2Response, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	enc, err := ioutil.ReadFile(f.path(teamID))
+	if os.IsNotExist(err) {
+		return nil, ErrTokenNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var tok OAuthV2Response
+	if err := decryptValue(f.key, enc, &tok); err != nil {
+		return nil, err
+	}
+	return &tok, nil
+}
+
+func (f *fileTokenStoreV2) Delete(teamID string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := os.Remove(f.path(teamID)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+func (f *fileTokenStoreV2) List() ([]string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	entries, err := ioutil.ReadDir(f.dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	teams := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		if !entry.IsDir() && filepath.Ext(entry.Name()) == ".json" {
+			teams = append(teams, strings.TrimSuffix(entry.Name(), ".json"))
+		}
+	}
+	return teams, nil
+}
+
+// redisTokenStoreV2 keeps each team's v2 token, keyed by teamID, in Redis.
+type redisTokenStoreV2 struct {
+	key    []byte
+	client RedisClient
+	prefix string
+}
+
+// NewRedisTokenStoreV2 creates a TokenStoreV2 that keeps v2 tokens in Redis
+// via client, keyed per team.
+func NewRedisTokenStoreV2(client RedisClient, encryptionKey []byte) (TokenStoreV2, error) {
+	if len(encryptionKey) == 0 {
+		return nil, errors.New("slackauth: encryption key can not be empty")
+	}
+	return &redisTokenStoreV2{key: encryptionKey, client: client, prefix: "slackauth:token_v2:"}, nil
+}
+
+func (r *redisTokenStoreV2) Put(teamID string, tok *OAuthV2Response) error {
+	enc, err := encryptValue(r.key, tok)
+	if err != nil {
+		return err
+	}
+	return r.client.Set(r.prefix+teamID, enc)
+}
+
+func (r *redisTokenStoreV2) Get(teamID string) (*OAuthV2Response, error) {
+	enc, err := r.client.Get(r.prefix + teamID)
+	if err != nil {
+		return nil, err
+	}
+	if enc == nil {
+		return nil, ErrTokenNotFound
+	}
+
+	var tok OAuthV2Response
+	if err := decryptValue(r.key, enc, &tok); err != nil {
+		return nil, err
+	}
+	return &tok, nil
+}
+
+func (r *redisTokenStoreV2) Delete(teamID string) error {
+	return r.client.Del(r.prefix + teamID)
+}
+
+func (r *redisTokenStoreV2) List() ([]string, error) {
+	keys, err := r.client.Keys(r.prefix + "*")
+	if err != nil {
+		return nil, err
+	}
+
+	teams := make([]string, len(keys))
+	for i, key := range keys {
+		teams[i] = strings.TrimPrefix(key, r.prefix)
+	}
+	return teams, nil
+}
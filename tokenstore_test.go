@@ -0,0 +1,197 @@
+package slackauth
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/nlopes/slack"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMemoryTokenStoreRoundTrip(t *testing.T) {
+	store := newMemoryTokenStore([]byte("0123456789abcdef"))
+	tok := &slack.OAuthResponse{AccessToken: "foo", TeamID: "T1"}
+
+	assert.Nil(t, store.Put("T1", tok))
+
+	got, err := store.Get("T1")
+	assert.Nil(t, err)
+	assert.Equal(t, tok, got)
+
+	teams, err := store.List()
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"T1"}, teams)
+
+	assert.Nil(t, store.Delete("T1"))
+	_, err = store.Get("T1")
+	assert.Equal(t, ErrTokenNotFound, err)
+}
+
+func TestMemoryTokenStoreWrongKey(t *testing.T) {
+	store := newMemoryTokenStore([]byte("0123456789abcdef"))
+	assert.Nil(t, store.Put("T1", &slack.OAuthResponse{AccessToken: "foo"}))
+
+	wrongKey := newMemoryTokenStore([]byte("fedcba9876543210"))
+	wrongKey.tokens = store.tokens
+
+	_, err := wrongKey.Get("T1")
+	assert.NotNil(t, err)
+}
+
+func TestFileTokenStoreRoundTrip(t *testing.T) {
+	dir, err := ioutil.TempDir("", "slackauth-tokenstore")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	store, err := NewFileTokenStore(dir, []byte("0123456789abcdef"))
+	assert.Nil(t, err)
+
+	tok := &slack.OAuthResponse{AccessToken: "foo", TeamID: "T1"}
+	assert.Nil(t, store.Put("T1", tok))
+
+	got, err := store.Get("T1")
+	assert.Nil(t, err)
+	assert.Equal(t, tok, got)
+
+	teams, err := store.List()
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"T1"}, teams)
+
+	assert.Nil(t, store.Delete("T1"))
+	_, err = store.Get("T1")
+	assert.Equal(t, ErrTokenNotFound, err)
+}
+
+func TestNewFileTokenStoreRequiresKey(t *testing.T) {
+	_, err := NewFileTokenStore("/tmp", nil)
+	assert.NotNil(t, err)
+}
+
+// fakeRedisClient is an in-memory stand-in for RedisClient, just enough to
+// exercise redisTokenStore without a real Redis server.
+type fakeRedisClient struct {
+	data map[string][]byte
+}
+
+func newFakeRedisClient() *fakeRedisClient {
+	return &fakeRedisClient{data: make(map[string][]byte)}
+}
+
+func (f *fakeRedisClient) Set(key string, value []byte) error {
+	f.data[key] = value
+	return nil
+}
+
+func (f *fakeRedisClient) Get(key string) ([]byte, error) {
+	return f.data[key], nil
+}
+
+func (f *fakeRedisClient) Del(key string) error {
+	delete(f.data, key)
+	return nil
+}
+
+func (f *fakeRedisClient) Keys(pattern string) ([]string, error) {
+	prefix := strings.TrimSuffix(pattern, "*")
+	var keys []string
+	for k := range f.data {
+		if strings.HasPrefix(k, prefix) {
+			keys = append(keys, k)
+		}
+	}
+	return keys, nil
+}
+
+func TestRedisTokenStoreRoundTrip(t *testing.T) {
+	client := newFakeRedisClient()
+	store, err := NewRedisTokenStore(client, []byte("0123456789abcdef"))
+	assert.Nil(t, err)
+
+	tok := &slack.OAuthResponse{AccessToken: "foo", TeamID: "T1"}
+	assert.Nil(t, store.Put("T1", tok))
+
+	got, err := store.Get("T1")
+	assert.Nil(t, err)
+	assert.Equal(t, tok, got)
+
+	teams, err := store.List()
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"T1"}, teams)
+
+	assert.Nil(t, store.Delete("T1"))
+	_, err = store.Get("T1")
+	assert.Equal(t, ErrTokenNotFound, err)
+}
+
+func TestNewRedisTokenStoreRequiresKey(t *testing.T) {
+	_, err := NewRedisTokenStore(newFakeRedisClient(), nil)
+	assert.NotNil(t, err)
+}
+
+func TestMemoryTokenStoreV2RoundTrip(t *testing.T) {
+	store := newMemoryTokenStoreV2([]byte("0123456789abcdef"))
+	tok := &OAuthV2Response{AccessToken: "bot-token", Team: OAuthV2Team{ID: "T1", Name: "Team One"}}
+
+	assert.Nil(t, store.Put("T1", tok))
+
+	got, err := store.Get("T1")
+	assert.Nil(t, err)
+	assert.Equal(t, tok, got)
+}
+
+func TestFileTokenStoreV2RoundTrip(t *testing.T) {
+	dir, err := ioutil.TempDir("", "slackauth-tokenstore-v2")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	store, err := NewFileTokenStoreV2(dir, []byte("0123456789abcdef"))
+	assert.Nil(t, err)
+
+	tok := &OAuthV2Response{AccessToken: "bot-token", Team: OAuthV2Team{ID: "T1", Name: "Team One"}}
+	assert.Nil(t, store.Put("T1", tok))
+
+	got, err := store.Get("T1")
+	assert.Nil(t, err)
+	assert.Equal(t, tok, got)
+
+	teams, err := store.List()
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"T1"}, teams)
+
+	assert.Nil(t, store.Delete("T1"))
+	_, err = store.Get("T1")
+	assert.Equal(t, ErrTokenNotFound, err)
+}
+
+func TestNewFileTokenStoreV2RequiresKey(t *testing.T) {
+	_, err := NewFileTokenStoreV2("/tmp", nil)
+	assert.NotNil(t, err)
+}
+
+func TestRedisTokenStoreV2RoundTrip(t *testing.T) {
+	client := newFakeRedisClient()
+	store, err := NewRedisTokenStoreV2(client, []byte("0123456789abcdef"))
+	assert.Nil(t, err)
+
+	tok := &OAuthV2Response{AccessToken: "bot-token", Team: OAuthV2Team{ID: "T1", Name: "Team One"}}
+	assert.Nil(t, store.Put("T1", tok))
+
+	got, err := store.Get("T1")
+	assert.Nil(t, err)
+	assert.Equal(t, tok, got)
+
+	teams, err := store.List()
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"T1"}, teams)
+
+	assert.Nil(t, store.Delete("T1"))
+	_, err = store.Get("T1")
+	assert.Equal(t, ErrTokenNotFound, err)
+}
+
+func TestNewRedisTokenStoreV2RequiresKey(t *testing.T) {
+	_, err := NewRedisTokenStoreV2(newFakeRedisClient(), nil)
+	assert.NotNil(t, err)
+}